@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+	col "github.com/pachyderm/pachyderm/src/server/pkg/collection"
+)
+
+// ListACLs returns every ACL in the cluster. It's admin-only, since GetACL
+// shows a repo's full ACL only to its OWNERs and admins (other callers see
+// just their own entries).
+func (a *apiServer) ListACLs(ctx context.Context, req *authclient.ListACLsRequest) (resp *authclient.ListACLsResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	resp = &authclient.ListACLsResponse{}
+	acl := &authclient.ACL{}
+	if err := a.acls.ReadOnly(ctx).List(acl, func(repo string) error {
+		resp.ACLs = append(resp.ACLs, &authclient.RepoACL{
+			Repo:    repo,
+			Entries: acl.Entries,
+		})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error listing ACLs: %v", err)
+	}
+
+	return resp, nil
+}
+
+// DeleteACL removes a repo's ACL entirely. It's admin-only; repo owners
+// revoke individual grants with SetScope instead.
+func (a *apiServer) DeleteACL(ctx context.Context, req *authclient.DeleteACLRequest) (resp *authclient.DeleteACLResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	_, err := col.NewSTM(ctx, a.etcdClient, func(stm col.STM) error {
+		return a.acls.ReadWrite(stm).Delete(req.Repo.Name)
+	})
+	caller, _ := a.getAuthorizedUser(ctx)
+	a.audit(ctx, AuditEvent{Action: "DeleteACL", Username: caller, Repo: req.Repo.Name, Success: err == nil, Err: errString(err)})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting ACL for repo %v: %v", req.Repo.Name, err)
+	}
+
+	return &authclient.DeleteACLResponse{}, nil
+}
+
+// ListTokens returns metadata about every outstanding (non-expired) token:
+// who it authenticates as, which provider issued it, and when it was
+// issued and expires. Token values themselves are never stored, so this
+// is the only way to audit what's been handed out. Admin-only.
+func (a *apiServer) ListTokens(ctx context.Context, req *authclient.ListTokensRequest) (resp *authclient.ListTokensResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	getResp, err := a.etcdClient.Get(ctx, a.tokenPrefix, etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("error listing tokens: %v", err)
+	}
+
+	resp = &authclient.ListTokensResponse{}
+	for _, kv := range getResp.Kvs {
+		var record tokenRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			continue
+		}
+		resp.Tokens = append(resp.Tokens, &authclient.TokenInfo{
+			Id:        path.Base(string(kv.Key)),
+			Subject:   record.Subject,
+			Provider:  record.Provider,
+			IssuedAt:  record.IssuedAt,
+			ExpiresAt: record.ExpiresAt,
+		})
+	}
+
+	return resp, nil
+}
+
+// RevokeToken deletes the revocation record of every token whose jti begins
+// with idPrefix, regardless of its etcd lease TTL, and reports how many were
+// deleted. verifyToken consults this record on every request, so a revoked
+// token stops working immediately.
+func (a *apiServer) RevokeToken(ctx context.Context, req *authclient.RevokeTokenRequest) (resp *authclient.RevokeTokenResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	delResp, err := a.etcdClient.Delete(ctx, path.Join(a.tokenPrefix, req.IdPrefix), etcd.WithPrefix())
+	caller, _ := a.getAuthorizedUser(ctx)
+	a.audit(ctx, AuditEvent{Action: "RevokeToken", Username: caller, TokenID: req.IdPrefix, Success: err == nil, Err: errString(err)})
+	if err != nil {
+		return nil, fmt.Errorf("error revoking token %v: %v", req.IdPrefix, err)
+	}
+
+	return &authclient.RevokeTokenResponse{
+		Revoked: delResp.Deleted,
+	}, nil
+}
+
+// WhoAmI returns the identity of whoever presented the auth token in ctx.
+func (a *apiServer) WhoAmI(ctx context.Context, req *authclient.WhoAmIRequest) (resp *authclient.WhoAmIResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	username, err := a.getAuthorizedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := a.isAdmin(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authclient.WhoAmIResponse{
+		Username: username,
+		IsAdmin:  admin,
+	}, nil
+}
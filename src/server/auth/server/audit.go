@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+)
+
+const (
+	auditLogPrefix = "/audit-log"
+)
+
+// errString returns err's message, or "" if err is nil, so audit events
+// can record a failure reason without a nil check at every call site.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// AuditEvent records the non-secret metadata of a single auth decision or
+// mutation. It deliberately has no field for the credential or token value
+// itself -- Authenticate already suppresses request/response logging to
+// avoid leaking the GitHub token, and the audit path must hold to the same
+// rule.
+type AuditEvent struct {
+	Timestamp time.Time
+	Action    string // e.g. "Authenticate", "Authorize", "SetScope", "DeleteACL"
+	Username  string
+	Provider  string
+	SourceIP  string
+	TokenID   string // the token's jti, or the jti prefix passed to RevokeToken
+	Repo      string
+	Scope     authclient.Scope_Scope
+	Success   bool
+	Err       string
+}
+
+// AuditSink receives audit events as they're recorded. The default sink
+// writes to etcd; a deployment can register an additional sink (e.g. to
+// ship events to an external log aggregator) via RegisterAuditSink.
+type AuditSink interface {
+	RecordEvent(ctx context.Context, event AuditEvent) error
+}
+
+// etcdAuditSink appends each event to etcd under auditLogPrefix, keyed by
+// timestamp so that GetAuditLog can scan a time range in order.
+type etcdAuditSink struct {
+	prefix string
+	a      *apiServer
+}
+
+func (s *etcdAuditSink) RecordEvent(ctx context.Context, event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling audit event: %v", err)
+	}
+
+	key := path.Join(s.prefix, fmt.Sprintf("%020d", event.Timestamp.UnixNano()))
+	if _, err := s.a.etcdClient.Put(ctx, key, string(data)); err != nil {
+		return fmt.Errorf("error writing audit event: %v", err)
+	}
+	return nil
+}
+
+// RegisterAuditSink adds an additional destination for audit events,
+// alongside the etcd log that's always written. It's meant to be called
+// once at startup to wire up an external sink.
+func (a *apiServer) RegisterAuditSink(sink AuditSink) {
+	a.auditSinks = append(a.auditSinks, sink)
+}
+
+// auditQueueSize bounds how many recorded-but-not-yet-written audit events
+// can sit in a.auditEvents. A full queue means the sinks (etcd, or
+// whatever RegisterAuditSink added) can't keep up; audit drops the event
+// and logs it rather than blocking the RPC that triggered it.
+const auditQueueSize = 1000
+
+// audit records event to every registered AuditSink. It never blocks the
+// calling RPC -- Authorize is the hottest path in this package, and a
+// synchronous etcd Put here would add exactly the round trip that caching
+// the signing key was meant to avoid. The event is instead handed to
+// a.auditEvents, a buffered channel drained by runAuditSinks in the
+// background; if the queue is full the event is dropped and logged rather
+// than applying backpressure to the caller.
+func (a *apiServer) audit(ctx context.Context, event AuditEvent) {
+	event.Timestamp = time.Now()
+	if p, ok := peer.FromContext(ctx); ok {
+		event.SourceIP = p.Addr.String()
+	}
+
+	select {
+	case a.auditEvents <- event:
+	default:
+		a.Log(nil, nil, fmt.Errorf("audit event queue full, dropping %v event for %v", event.Action, event.Username), 0)
+	}
+}
+
+// runAuditSinks drains a.auditEvents and forwards each event to every
+// registered AuditSink. It runs for the lifetime of the server in its own
+// goroutine, started by NewAuthServer, so that a slow or unavailable sink
+// never adds latency to the RPC that recorded the event -- only to how
+// quickly the event shows up in GetAuditLog.
+func (a *apiServer) runAuditSinks() {
+	for event := range a.auditEvents {
+		for _, sink := range a.auditSinks {
+			if err := sink.RecordEvent(context.Background(), event); err != nil {
+				a.Log(nil, nil, fmt.Errorf("error recording audit event: %v", err), 0)
+			}
+		}
+	}
+}
+
+// GetAuditLog returns recorded audit events matching req's filters. It's
+// admin-only, since the log can reveal who has access to what.
+func (a *apiServer) GetAuditLog(ctx context.Context, req *authclient.GetAuditLogRequest) (resp *authclient.GetAuditLogResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	getResp, err := a.etcdClient.Get(ctx, a.auditLogPrefix, etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+
+	resp = &authclient.GetAuditLogResponse{}
+	for _, kv := range getResp.Kvs {
+		var event AuditEvent
+		if err := json.Unmarshal(kv.Value, &event); err != nil {
+			continue
+		}
+		if req.Username != "" && event.Username != req.Username {
+			continue
+		}
+		if req.Repo != "" && event.Repo != req.Repo {
+			continue
+		}
+		if req.Since != 0 && event.Timestamp.Unix() < req.Since {
+			continue
+		}
+		if req.Until != 0 && event.Timestamp.Unix() > req.Until {
+			continue
+		}
+		if req.SuccessOnly && !event.Success {
+			continue
+		}
+
+		resp.Events = append(resp.Events, &authclient.AuditEvent{
+			Timestamp: event.Timestamp.Unix(),
+			Action:    event.Action,
+			Username:  event.Username,
+			Provider:  event.Provider,
+			SourceIP:  event.SourceIP,
+			TokenID:   event.TokenID,
+			Repo:      event.Repo,
+			Scope:     event.Scope,
+			Success:   event.Success,
+			Err:       event.Err,
+		})
+	}
+
+	return resp, nil
+}
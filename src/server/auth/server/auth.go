@@ -1,26 +1,25 @@
 package auth
 
 import (
-	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"path"
+	"sync"
 	"time"
 
 	etcd "github.com/coreos/etcd/clientv3"
-	"github.com/google/go-github/github"
 	"go.pedge.io/proto/rpclog"
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
 
 	"github.com/pachyderm/pachyderm/src/client"
 	authclient "github.com/pachyderm/pachyderm/src/client/auth"
-	"github.com/pachyderm/pachyderm/src/client/pkg/uuid"
 	col "github.com/pachyderm/pachyderm/src/server/pkg/collection"
 )
 
 const (
-	tokensPrefix = "/pach-tokens"
-	aclsPrefix   = "/acls"
+	tokensPrefix     = "/pach-tokens"
+	aclsPrefix       = "/acls"
+	signingKeyPrefix = "/signing-key"
 
 	defaultTokenTTLSecs = 24 * 60 * 60
 	authnToken          = "authn-token"
@@ -30,8 +29,50 @@ type apiServer struct {
 	protorpclog.Logger
 	etcdClient  *etcd.Client
 	tokenPrefix string
-	// acls is a collection of repoName -> ACL mappings.
+	// signingKeyPrefix is the etcd key holding the active JWT signing key.
+	signingKeyPrefix string
+	// acls is a collection of repoName -> ACL mappings. Entries are
+	// "user:"/"group:"/"role:" prefixed principals rather than bare
+	// usernames; see Identity and scopeFromACL.
 	acls col.Collection
+	// admins is a set of usernames who bypass ACLs entirely. It used to be
+	// folded into the acls collection (a User record keyed by username),
+	// which made that keyspace do double duty; it's now its own collection.
+	admins col.Collection
+	// roles is a collection of role name -> Role, letting an ACL entry of
+	// "role:<name>" grant access to every principal listed as a member.
+	roles col.Collection
+	// identityResolver turns an authenticated username plus the groups its
+	// provider vouches for into a full Identity, adding roles.
+	identityResolver IdentityResolver
+	// providersPrefix is the etcd key prefix provider configuration is
+	// stored under; watchIDProviders watches it to keep providers current.
+	providersPrefix string
+	// providersMu guards providers, which is written by loadIDProviders
+	// (initially, and on every watchIDProviders reload) and read
+	// concurrently by every Authenticate call.
+	providersMu sync.RWMutex
+	// providers maps a provider name (e.g. "github") to the IDProvider that
+	// handles Authenticate requests naming it.
+	providers map[string]IDProvider
+	// auditLogPrefix is the etcd key prefix audit events are appended under.
+	auditLogPrefix string
+	// auditSinks receive every recorded AuditEvent. The etcd sink is always
+	// registered; RegisterAuditSink adds any others.
+	auditSinks []AuditSink
+	// auditEvents decouples audit from its sinks, so that recording an
+	// event never blocks the RPC that triggered it; see audit and
+	// runAuditSinks.
+	auditEvents chan AuditEvent
+
+	// signingKeyMu guards cachedSigningKeys, which is read on every
+	// verifyToken call (the Authorize hot path) and written by
+	// writeSigningKeys and the signing-key watch started in NewAuthServer.
+	signingKeyMu sync.RWMutex
+	// cachedSigningKeys holds the active signing key (index 0, used to sign
+	// new tokens) plus however many prior keys RotateSigningKey has chosen
+	// to retain for verifyToken, newest first. See signingKeyHistory.
+	cachedSigningKeys []*signingKey
 }
 
 // NewAuthServer returns an implementation of auth.APIServer.
@@ -44,10 +85,19 @@ func NewAuthServer(etcdAddress string, etcdPrefix string) (authclient.APIServer,
 		return nil, fmt.Errorf("error constructing etcdClient: %v", err)
 	}
 
-	return &apiServer{
-		Logger:      protorpclog.NewLogger("auth.API"),
-		etcdClient:  etcdClient,
-		tokenPrefix: path.Join(etcdPrefix, tokensPrefix),
+	roles := col.NewCollection(
+		etcdClient,
+		path.Join(etcdPrefix, rolesPrefix),
+		nil,
+		&Role{},
+		nil,
+	)
+
+	a := &apiServer{
+		Logger:           protorpclog.NewLogger("auth.API"),
+		etcdClient:       etcdClient,
+		tokenPrefix:      path.Join(etcdPrefix, tokensPrefix),
+		signingKeyPrefix: path.Join(etcdPrefix, signingKeyPrefix),
 		acls: col.NewCollection(
 			etcdClient,
 			path.Join(etcdPrefix, aclsPrefix),
@@ -55,7 +105,93 @@ func NewAuthServer(etcdAddress string, etcdPrefix string) (authclient.APIServer,
 			&authclient.ACL{},
 			nil,
 		),
-	}, nil
+		admins: col.NewCollection(
+			etcdClient,
+			path.Join(etcdPrefix, adminsPrefix),
+			nil,
+			&authclient.User{},
+			nil,
+		),
+		roles:            roles,
+		identityResolver: newIdentityResolver(roles),
+		providersPrefix:  path.Join(etcdPrefix, providersPrefix),
+		auditLogPrefix:   path.Join(etcdPrefix, auditLogPrefix),
+	}
+	a.auditSinks = []AuditSink{&etcdAuditSink{prefix: a.auditLogPrefix, a: a}}
+	a.auditEvents = make(chan AuditEvent, auditQueueSize)
+
+	if err := a.loadIDProviders(context.Background()); err != nil {
+		return nil, fmt.Errorf("error loading identity providers: %v", err)
+	}
+	go a.watchIDProviders()
+	go a.watchSigningKey()
+	go a.runAuditSinks()
+
+	return a, nil
+}
+
+// loadIDProviders reads the provider configuration stored under
+// a.providersPrefix and replaces a.providers with the corresponding
+// IDProviders. GitHub is always registered, since it requires no
+// configuration and is the long-standing default. It's called once at
+// startup and again on every watchIDProviders event, so that adding or
+// reconfiguring an LDAP/OIDC provider in etcd takes effect without
+// restarting pachd.
+func (a *apiServer) loadIDProviders(ctx context.Context) error {
+	providers := map[string]IDProvider{
+		githubProviderName: githubProvider{},
+	}
+
+	resp, err := a.etcdClient.Get(ctx, a.providersPrefix, etcd.WithPrefix())
+	if err != nil {
+		return fmt.Errorf("error reading provider config from etcd: %v", err)
+	}
+
+	for _, kv := range resp.Kvs {
+		name := path.Base(string(kv.Key))
+		switch name {
+		case ldapProviderName:
+			var config LDAPConfig
+			if err := json.Unmarshal(kv.Value, &config); err != nil {
+				return fmt.Errorf("error unmarshalling LDAP provider config: %v", err)
+			}
+			providers[ldapProviderName] = newLDAPProvider(config)
+		case oidcProviderName:
+			var config OIDCConfig
+			if err := json.Unmarshal(kv.Value, &config); err != nil {
+				return fmt.Errorf("error unmarshalling OIDC provider config: %v", err)
+			}
+			provider, err := newOIDCProvider(ctx, config)
+			if err != nil {
+				return err
+			}
+			providers[oidcProviderName] = provider
+		case tlsProviderName:
+			providers[tlsProviderName] = tlsProvider{}
+		}
+	}
+
+	a.providersMu.Lock()
+	a.providers = providers
+	a.providersMu.Unlock()
+	return nil
+}
+
+// watchIDProviders watches a.providersPrefix and reloads a.providers on
+// every change. It runs for the lifetime of the server; a failed reload is
+// logged rather than fatal, leaving the previous provider set in place
+// until the next successful one.
+func (a *apiServer) watchIDProviders() {
+	watcher := a.etcdClient.Watch(context.Background(), a.providersPrefix, etcd.WithPrefix())
+	for resp := range watcher {
+		if err := resp.Err(); err != nil {
+			a.Log(nil, nil, fmt.Errorf("error watching provider config: %v", err), 0)
+			continue
+		}
+		if err := a.loadIDProviders(context.Background()); err != nil {
+			a.Log(nil, nil, fmt.Errorf("error reloading provider config: %v", err), 0)
+		}
+	}
 }
 
 func (a *apiServer) Authenticate(ctx context.Context, req *authclient.AuthenticateRequest) (resp *authclient.AuthenticateResponse, retErr error) {
@@ -63,34 +199,36 @@ func (a *apiServer) Authenticate(ctx context.Context, req *authclient.Authentica
 	// credentials.
 	defer func(start time.Time) { a.Log(nil, nil, retErr, time.Since(start)) }(time.Now())
 
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{
-			AccessToken: req.GithubToken,
-		},
-	)
-	tc := oauth2.NewClient(ctx, ts)
+	providerName := req.Provider
+	if providerName == "" {
+		providerName = githubProviderName
+	}
 
-	gclient := github.NewClient(tc)
+	a.providersMu.RLock()
+	provider, ok := a.providers[providerName]
+	a.providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown identity provider %q", providerName)
+	}
 
-	// Passing the empty string gets us the authenticated user
-	user, _, err := gclient.Users.Get(ctx, "")
+	username, groups, err := provider.AuthenticateCredentials(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("error getting the authenticated user: %v", err)
+		a.audit(ctx, AuditEvent{Action: "Authenticate", Provider: providerName, Success: false, Err: err.Error()})
+		return nil, fmt.Errorf("error authenticating via %v provider: %v", providerName, err)
 	}
 
-	username := user.GetName()
-	pachToken := uuid.NewWithoutDashes()
-
-	lease, err := a.etcdClient.Grant(ctx, defaultTokenTTLSecs)
+	admin, err := a.isAdmin(ctx, username)
 	if err != nil {
-		return nil, fmt.Errorf("error granting token TTL: %v", err)
+		return nil, err
 	}
 
-	_, err = a.etcdClient.Put(ctx, path.Join(a.tokenPrefix, hashToken(pachToken)), username, etcd.WithLease(lease.ID))
+	pachToken, err := a.generateToken(ctx, username, groups, admin, providerName, defaultTokenTTLSecs)
 	if err != nil {
-		return nil, fmt.Errorf("error storing the auth token: %v", err)
+		a.audit(ctx, AuditEvent{Action: "Authenticate", Username: username, Provider: providerName, Success: false, Err: err.Error()})
+		return nil, fmt.Errorf("error generating auth token: %v", err)
 	}
 
+	a.audit(ctx, AuditEvent{Action: "Authenticate", Username: username, Provider: providerName, Success: true})
 	return &authclient.AuthenticateResponse{
 		PachToken: pachToken,
 	}, nil
@@ -100,7 +238,7 @@ func (a *apiServer) Authorize(ctx context.Context, req *authclient.AuthorizeRequ
 	func() { a.Log(req, nil, nil, 0) }()
 	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
 
-	user, err := a.getAuthorizedUser(ctx)
+	claims, identity, err := a.authorizedIdentity(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -113,26 +251,30 @@ func (a *apiServer) Authorize(ctx context.Context, req *authclient.AuthorizeRequ
 		return nil, fmt.Errorf("error getting ACL for repo %v: %v", req.Repo.Name, err)
 	}
 
-	if req.Scope == acl.Entries[user] {
+	scope := a.authorizedScope(identity, req.Repo.Name, acl, claims.Scope)
+	if req.Scope == scope {
+		a.audit(ctx, AuditEvent{Action: "Authorize", Username: identity.Username, Repo: req.Repo.Name, Scope: req.Scope, Success: true})
 		return &authclient.AuthorizeResponse{
 			Authorized: true,
 		}, nil
 	}
 
-	// If the user cannot authorize via ACL, we check if they are an admin.
-	var _u authclient.User
-	if err := a.acls.ReadOnly(ctx).Get(user, &_u); err != nil {
-		if _, ok := err.(col.ErrNotFound); ok {
-			return &authclient.AuthorizeResponse{
-				Authorized: false,
-			}, nil
+	// If the caller cannot authorize via ACL, we check if they are an admin.
+	// Admins always authorize -- unless the presented token is itself
+	// scoped, in which case it must stand on the ACL grant like any other
+	// scoped token. Otherwise a scoped token minted from an admin's
+	// identity (e.g. handed to a pipeline worker) would authorize for
+	// every repo and scope, defeating the point of GetScopedToken.
+	var admin bool
+	if claims.Scope == nil {
+		admin, err = a.isAdmin(ctx, identity.Username)
+		if err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("error checking if user %v is an admin: %v", user, err)
 	}
-
-	// Admins always authorize
+	a.audit(ctx, AuditEvent{Action: "Authorize", Username: identity.Username, Repo: req.Repo.Name, Scope: req.Scope, Success: admin})
 	return &authclient.AuthorizeResponse{
-		Authorized: true,
+		Authorized: admin,
 	}, nil
 }
 
@@ -140,11 +282,15 @@ func (a *apiServer) SetScope(ctx context.Context, req *authclient.SetScopeReques
 	func() { a.Log(req, nil, nil, 0) }()
 	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
 
-	user, err := a.getAuthorizedUser(ctx)
+	claims, identity, err := a.authorizedIdentity(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if claims.Scope != nil {
+		return nil, fmt.Errorf("cannot update an ACL with a scoped token")
+	}
+
 	_, err = col.NewSTM(ctx, a.etcdClient, func(stm col.STM) error {
 		acls := a.acls.ReadWrite(stm)
 
@@ -153,14 +299,22 @@ func (a *apiServer) SetScope(ctx context.Context, req *authclient.SetScopeReques
 			return fmt.Errorf("ACL not found for repo %v", req.Repo.Name)
 		}
 
-		if acl.Entries[user] != authclient.Scope_OWNER {
-			return fmt.Errorf("user %v is not authorized to update ACL for repo %v", user, req.Repo.Name)
+		if scopeFromACL(acl, identity) != authclient.Scope_OWNER {
+			return fmt.Errorf("user %v is not authorized to update ACL for repo %v", identity.Username, req.Repo.Name)
 		}
 
-		acl.Entries[req.Username] = req.Scope
+		acl.Entries[normalizePrincipal(req.Username)] = req.Scope
 		acls.Put(req.Repo.Name, &acl)
 		return nil
 	})
+	a.audit(ctx, AuditEvent{
+		Action:   "SetScope",
+		Username: identity.Username,
+		Repo:     req.Repo.Name,
+		Scope:    req.Scope,
+		Success:  err == nil,
+		Err:      errString(err),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -168,41 +322,153 @@ func (a *apiServer) SetScope(ctx context.Context, req *authclient.SetScopeReques
 	return &authclient.SetScopeResponse{}, nil
 }
 
+// GetScope returns the caller's scope on each repo in req.Repos, or, if
+// req.Username is set, that user's scope instead (only an OWNER or admin
+// may ask about someone else).
 func (a *apiServer) GetScope(ctx context.Context, req *authclient.GetScopeRequest) (resp *authclient.GetScopeResponse, retErr error) {
 	func() { a.Log(req, nil, nil, 0) }()
 	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
-	return nil, fmt.Errorf("TODO")
+
+	claims, identity, err := a.authorizedIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	target := req.Username
+
+	resp = &authclient.GetScopeResponse{
+		Scopes: make([]authclient.Scope_Scope, len(req.Repos)),
+	}
+	for i, repo := range req.Repos {
+		var acl authclient.ACL
+		if err := a.acls.ReadOnly(ctx).Get(repo.Name, &acl); err != nil {
+			if _, ok := err.(col.ErrNotFound); ok {
+				continue
+			}
+			return nil, fmt.Errorf("error getting ACL for repo %v: %v", repo.Name, err)
+		}
+
+		if target != "" && target != identity.Username {
+			callerScope := a.authorizedScope(identity, repo.Name, acl, claims.Scope)
+			admin, err := a.isAdmin(ctx, identity.Username)
+			if err != nil {
+				return nil, err
+			}
+			if callerScope != authclient.Scope_OWNER && !admin {
+				return nil, fmt.Errorf("user %v is not authorized to view %v's scope on repo %v", identity.Username, target, repo.Name)
+			}
+			resp.Scopes[i] = acl.Entries[normalizePrincipal(target)]
+			continue
+		}
+
+		resp.Scopes[i] = a.authorizedScope(identity, repo.Name, acl, claims.Scope)
+	}
+
+	return resp, nil
 }
 
+// GetACL returns the ACL for req.Repo. Callers with OWNER scope (or who
+// are admins) see every entry; everyone else only sees their own.
 func (a *apiServer) GetACL(ctx context.Context, req *authclient.GetACLRequest) (resp *authclient.GetACLResponse, retErr error) {
 	func() { a.Log(req, nil, nil, 0) }()
 	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
-	return nil, fmt.Errorf("TODO")
+
+	claims, identity, err := a.authorizedIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acl authclient.ACL
+	if err := a.acls.ReadOnly(ctx).Get(req.Repo.Name, &acl); err != nil {
+		if _, ok := err.(col.ErrNotFound); ok {
+			return nil, fmt.Errorf("ACL not found for repo %v", req.Repo.Name)
+		}
+		return nil, fmt.Errorf("error getting ACL for repo %v: %v", req.Repo.Name, err)
+	}
+
+	callerScope := a.authorizedScope(identity, req.Repo.Name, acl, claims.Scope)
+	admin, err := a.isAdmin(ctx, identity.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if callerScope == authclient.Scope_OWNER || admin {
+		return &authclient.GetACLResponse{Entries: acl.Entries}, nil
+	}
+
+	entries := make(map[string]authclient.Scope_Scope)
+	for _, principal := range identity.Principals() {
+		if scope, ok := acl.Entries[principal]; ok {
+			entries[principal] = scope
+		}
+	}
+	return &authclient.GetACLResponse{Entries: entries}, nil
+}
+
+// authorizedIdentity verifies the token presented in ctx once and resolves
+// the caller's full Identity (username, groups, roles) from it, returning
+// the parsed claims alongside. Callers that also need the token's embedded
+// Scope (Authorize, GetScope, GetACL) should read it off the returned
+// claims and pass it to authorizedScope, rather than verifying the token a
+// second time.
+func (a *apiServer) authorizedIdentity(ctx context.Context) (*pachClaims, *Identity, error) {
+	claims, err := a.claimsFromContext(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("auth token not found: %v", err)
+	}
+
+	identity, err := a.identityResolver.ResolveIdentity(ctx, claims.Subject, claims.Groups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, identity, nil
 }
 
-// hashToken converts a token to a cryptographic hash.
-// We don't want to store tokens verbatim in the database, as then whoever
-// that has access to the database has access to all tokens.
-func hashToken(token string) string {
-	sum := sha256.Sum256([]byte(token))
-	return fmt.Sprintf("%x", sum)
+// getAuthorizedIdentity resolves the full Identity (username, groups,
+// roles) of whoever presented the auth token in ctx.
+func (a *apiServer) getAuthorizedIdentity(ctx context.Context) (*Identity, error) {
+	_, identity, err := a.authorizedIdentity(ctx)
+	return identity, err
 }
 
 func (a *apiServer) getAuthorizedUser(ctx context.Context) (string, error) {
-	token := ctx.Value(authnToken)
-	if token == nil {
-		return "", fmt.Errorf("auth token not found in context")
+	identity, err := a.getAuthorizedIdentity(ctx)
+	if err != nil {
+		return "", err
 	}
+	return identity.Username, nil
+}
 
-	tokenStr, ok := token.(string)
-	if !ok {
-		return "", fmt.Errorf("auth token found in context is malformed")
+// isAdmin reports whether username is in the dedicated admins collection.
+func (a *apiServer) isAdmin(ctx context.Context, username string) (bool, error) {
+	var _u authclient.User
+	if err := a.admins.ReadOnly(ctx).Get(username, &_u); err != nil {
+		if _, ok := err.(col.ErrNotFound); ok {
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking if user %v is an admin: %v", username, err)
 	}
+	return true, nil
+}
 
-	resp, err := a.etcdClient.Get(ctx, path.Join(a.tokenPrefix, hashToken(tokenStr)))
+// requireAdmin resolves the caller's identity from ctx and returns an
+// error if they are not an admin. It's used to gate admin-only RPCs like
+// GenerateSigningKey.
+func (a *apiServer) requireAdmin(ctx context.Context) error {
+	claims, identity, err := a.authorizedIdentity(ctx)
 	if err != nil {
-		return "", fmt.Errorf("auth token not found: %v", err)
+		return err
+	}
+	if claims.Scope != nil {
+		return fmt.Errorf("admin actions are not permitted with a scoped token")
 	}
 
-	return string(resp.Kvs[0].Value), nil
+	admin, err := a.isAdmin(ctx, identity.Username)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return fmt.Errorf("user %v is not an admin", identity.Username)
+	}
+	return nil
 }
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+	col "github.com/pachyderm/pachyderm/src/server/pkg/collection"
+)
+
+const (
+	rolesPrefix  = "/roles"
+	adminsPrefix = "/admins"
+
+	userPrincipalPrefix  = "user:"
+	groupPrincipalPrefix = "group:"
+	rolePrincipalPrefix  = "role:"
+)
+
+func userPrincipal(name string) string  { return userPrincipalPrefix + name }
+func groupPrincipal(name string) string { return groupPrincipalPrefix + name }
+func rolePrincipal(name string) string  { return rolePrincipalPrefix + name }
+
+// normalizePrincipal returns s unchanged if it's already a "user:",
+// "group:", or "role:" prefixed principal, and otherwise treats it as a
+// bare username for backwards-compatible callers (e.g. SetScopeRequest's
+// Username field, which predates group/role grants).
+func normalizePrincipal(s string) string {
+	if strings.HasPrefix(s, userPrincipalPrefix) ||
+		strings.HasPrefix(s, groupPrincipalPrefix) ||
+		strings.HasPrefix(s, rolePrincipalPrefix) {
+		return s
+	}
+	return userPrincipal(s)
+}
+
+// Role is a named bundle of principals, stored in the roles collection.
+// An ACL entry of "role:<name>" grants scope to every user or group
+// listed as a Member of that role, which lets an admin regrant access to
+// many repos at once by editing one role instead of every ACL.
+type Role struct {
+	// Members are "user:<name>" or "group:<name>" principals.
+	Members []string
+}
+
+// Identity is the caller resolved from an auth token: a username plus the
+// groups and roles it belongs to. Authorize grants access if any of these
+// principals has sufficient scope on the ACL, rather than just the bare
+// username.
+type Identity struct {
+	Username string
+	Groups   []string
+	Roles    []string
+}
+
+// Principals returns every principal string that identifies i -- its
+// username, each of its groups, and each of its roles -- so callers can
+// walk an ACL's entries looking for a match.
+func (i *Identity) Principals() []string {
+	principals := make([]string, 0, 1+len(i.Groups)+len(i.Roles))
+	principals = append(principals, userPrincipal(i.Username))
+	for _, g := range i.Groups {
+		principals = append(principals, groupPrincipal(g))
+	}
+	for _, r := range i.Roles {
+		principals = append(principals, rolePrincipal(r))
+	}
+	return principals
+}
+
+// IdentityResolver turns a username plus the groups its identity provider
+// vouched for into a full Identity, adding any roles the roles collection
+// grants to that username or one of those groups. It's pluggable so that
+// group membership can come from GitHub org membership, LDAP memberOf, or
+// an OIDC groups claim, while role resolution stays uniform.
+type IdentityResolver interface {
+	ResolveIdentity(ctx context.Context, username string, groups []string) (*Identity, error)
+}
+
+// etcdIdentityResolver is the only IdentityResolver implementation: it
+// trusts the groups handed to it by the identity provider and resolves
+// roles by scanning the roles collection for matching members.
+type etcdIdentityResolver struct {
+	roles col.Collection
+}
+
+func newIdentityResolver(roles col.Collection) IdentityResolver {
+	return &etcdIdentityResolver{roles: roles}
+}
+
+func (r *etcdIdentityResolver) ResolveIdentity(ctx context.Context, username string, groups []string) (*Identity, error) {
+	identity := &Identity{
+		Username: username,
+		Groups:   groups,
+	}
+
+	memberOf := make(map[string]bool)
+	memberOf[userPrincipal(username)] = true
+	for _, g := range groups {
+		memberOf[groupPrincipal(g)] = true
+	}
+
+	var role Role
+	if err := r.roles.ReadOnly(ctx).List(&role, func(name string) error {
+		for _, member := range role.Members {
+			if memberOf[member] {
+				identity.Roles = append(identity.Roles, name)
+				return nil
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error resolving roles for %v: %v", username, err)
+	}
+
+	return identity, nil
+}
+
+// scopeFromACL returns the maximum scope granted to any of identity's
+// principals in acl.
+func scopeFromACL(acl authclient.ACL, identity *Identity) authclient.Scope_Scope {
+	var max authclient.Scope_Scope
+	for _, principal := range identity.Principals() {
+		if scope := acl.Entries[principal]; scope > max {
+			max = scope
+		}
+	}
+	return max
+}
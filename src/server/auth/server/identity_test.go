@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+)
+
+func TestPrincipals(t *testing.T) {
+	identity := &Identity{
+		Username: "alice",
+		Groups:   []string{"eng"},
+		Roles:    []string{"on-call"},
+	}
+	want := []string{"user:alice", "group:eng", "role:on-call"}
+	if got := identity.Principals(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Principals() = %v, want %v", got, want)
+	}
+}
+
+func TestNormalizePrincipal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"alice", "user:alice"},
+		{"user:alice", "user:alice"},
+		{"group:eng", "group:eng"},
+		{"role:on-call", "role:on-call"},
+	}
+	for _, test := range tests {
+		if got := normalizePrincipal(test.in); got != test.want {
+			t.Errorf("normalizePrincipal(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestScopeFromACL(t *testing.T) {
+	acl := authclient.ACL{Entries: map[string]authclient.Scope_Scope{
+		userPrincipal("alice"):    authclient.Scope_READER,
+		groupPrincipal("eng"):     authclient.Scope_WRITER,
+		rolePrincipal("on-call"):  authclient.Scope_OWNER,
+		userPrincipal("stranger"): authclient.Scope_OWNER,
+	}}
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		want     authclient.Scope_Scope
+	}{
+		{
+			name:     "grant via username only",
+			identity: &Identity{Username: "alice"},
+			want:     authclient.Scope_READER,
+		},
+		{
+			name:     "group grant exceeds username grant",
+			identity: &Identity{Username: "alice", Groups: []string{"eng"}},
+			want:     authclient.Scope_WRITER,
+		},
+		{
+			name:     "role grant is the max across all principals",
+			identity: &Identity{Username: "alice", Groups: []string{"eng"}, Roles: []string{"on-call"}},
+			want:     authclient.Scope_OWNER,
+		},
+		{
+			name:     "no matching principal grants nothing",
+			identity: &Identity{Username: "bob"},
+			want:     authclient.Scope_NONE,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := scopeFromACL(acl, test.identity); got != test.want {
+				t.Errorf("scopeFromACL() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
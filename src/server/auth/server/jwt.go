@@ -0,0 +1,431 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+	"github.com/pachyderm/pachyderm/src/client/pkg/uuid"
+)
+
+// pachClaims are the JWT claims carried in a Pach token. Besides the
+// registered claims (sub, iat, exp, jti), a token records whether its
+// holder was an admin at Authenticate time. Admin status can change (or be
+// revoked) before the token expires, so every admin-gated check in this
+// package re-resolves it live via isAdmin rather than trusting this field;
+// it exists for informational use by external consumers that decode the
+// token themselves.
+type pachClaims struct {
+	jwt.StandardClaims
+	Admin bool `json:"admin"`
+	// Groups are the groups the identity provider vouched for at
+	// Authenticate time (GitHub orgs, LDAP memberOf, OIDC groups claim).
+	// They're baked into the token rather than re-fetched on every request.
+	Groups []string `json:"groups,omitempty"`
+	// Scope, if set, restricts this token to the (repo, max-scope) grants it
+	// lists instead of the subject's full identity. See GetScopedToken.
+	Scope *authclient.Scope `json:"scope,omitempty"`
+}
+
+// signingKey is the key material used to sign and verify Pach tokens. It's
+// stored in etcd (as part of a signingKeyHistory) so that every pachd
+// replica signs and verifies with the same key, and so that
+// RotateSigningKey can replace it without a restart.
+type signingKey struct {
+	Method     string // "RS256" or "HS256"
+	PrivateKey []byte // PEM-encoded RSA private key, or raw HMAC secret
+	PublicKey  []byte // PEM-encoded RSA public key; unset for HS256
+}
+
+// maxSigningKeyHistory bounds how many keys RotateSigningKey retains for
+// verification. Keeping more than one lets tokens signed before the most
+// recent rotation keep verifying until they expire, as RotateSigningKey's
+// doc comment promises; keeping only a bounded number (rather than every
+// key ever generated) keeps verifyToken's per-candidate retry cheap and
+// bounds etcd storage.
+const maxSigningKeyHistory = 2
+
+// signingKeyHistory is what's actually stored at signingKeyPrefix. Keys[0]
+// is the active key used to sign new tokens; the rest, if any, are retained
+// only so verifyToken can still validate tokens signed before the last
+// rotation.
+type signingKeyHistory struct {
+	Keys []signingKey
+}
+
+// loadSigningKeys returns the signing key history (active key first),
+// serving it from a.cachedSigningKeys when possible so that verifyToken --
+// called on every authenticated RPC -- doesn't cost an etcd round trip in
+// addition to the revocation check. The cache is kept fresh by
+// watchSigningKey rather than by re-reading here, since pachd runs
+// multiple replicas and only the replica that calls RotateSigningKey would
+// otherwise see the change.
+func (a *apiServer) loadSigningKeys(ctx context.Context) ([]*signingKey, error) {
+	a.signingKeyMu.RLock()
+	keys := a.cachedSigningKeys
+	a.signingKeyMu.RUnlock()
+	if keys != nil {
+		return keys, nil
+	}
+
+	resp, err := a.etcdClient.Get(ctx, a.signingKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key from etcd: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("no signing key has been generated; call GenerateSigningKey first")
+	}
+
+	keys, err = unmarshalSigningKeys(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	a.signingKeyMu.Lock()
+	a.cachedSigningKeys = keys
+	a.signingKeyMu.Unlock()
+	return keys, nil
+}
+
+func unmarshalSigningKeys(data []byte) ([]*signingKey, error) {
+	var history signingKeyHistory
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("error unmarshalling signing key: %v", err)
+	}
+	keys := make([]*signingKey, len(history.Keys))
+	for i := range history.Keys {
+		keys[i] = &history.Keys[i]
+	}
+	return keys, nil
+}
+
+// watchSigningKey watches signingKeyPrefix and keeps a.cachedSigningKeys in
+// sync with etcd, so that a RotateSigningKey issued against one pachd
+// replica takes effect on every other replica's verifyToken without a
+// restart. It runs for the lifetime of the server; a watch error just
+// means the cache goes stale until the next successful write, so it's
+// logged rather than fatal.
+func (a *apiServer) watchSigningKey() {
+	watcher := a.etcdClient.Watch(context.Background(), a.signingKeyPrefix)
+	for resp := range watcher {
+		if err := resp.Err(); err != nil {
+			a.Log(nil, nil, fmt.Errorf("error watching signing key: %v", err), 0)
+			continue
+		}
+		for _, ev := range resp.Events {
+			if ev.Type != etcd.EventTypePut {
+				continue
+			}
+			keys, err := unmarshalSigningKeys(ev.Kv.Value)
+			if err != nil {
+				a.Log(nil, nil, fmt.Errorf("error unmarshalling signing key from watch: %v", err), 0)
+				continue
+			}
+			a.signingKeyMu.Lock()
+			a.cachedSigningKeys = keys
+			a.signingKeyMu.Unlock()
+		}
+	}
+}
+
+// GenerateSigningKey creates an RS256 key pair (or, if req.HMACSecret is
+// set, an HS256 secret instead) and writes it to etcd as the active
+// signing key for new Pach tokens.
+func (a *apiServer) GenerateSigningKey(ctx context.Context, req *authclient.GenerateSigningKeyRequest) (resp *authclient.GenerateSigningKeyResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	key, err := newSigningKey(req.HMACSecret)
+	if err != nil {
+		return nil, err
+	}
+	err = a.putSigningKey(ctx, key)
+	caller, _ := a.getAuthorizedUser(ctx)
+	a.audit(ctx, AuditEvent{Action: "GenerateSigningKey", Username: caller, Success: err == nil, Err: errString(err)})
+	if err != nil {
+		return nil, err
+	}
+	return &authclient.GenerateSigningKeyResponse{}, nil
+}
+
+// RotateSigningKey replaces the active signing key, retaining up to
+// maxSigningKeyHistory-1 of the keys it displaces so that tokens already
+// signed with them remain valid until their TTL expires; there's no way to
+// force them invalid short of revoking each one individually.
+func (a *apiServer) RotateSigningKey(ctx context.Context, req *authclient.RotateSigningKeyRequest) (resp *authclient.RotateSigningKeyResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	if err := a.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	key, err := newSigningKey(req.HMACSecret)
+	if err != nil {
+		return nil, err
+	}
+	err = a.rotateSigningKey(ctx, key)
+	caller, _ := a.getAuthorizedUser(ctx)
+	a.audit(ctx, AuditEvent{Action: "RotateSigningKey", Username: caller, Success: err == nil, Err: errString(err)})
+	if err != nil {
+		return nil, err
+	}
+	return &authclient.RotateSigningKeyResponse{}, nil
+}
+
+func newSigningKey(hmacSecret []byte) (*signingKey, error) {
+	if len(hmacSecret) > 0 {
+		return &signingKey{Method: "HS256", PrivateKey: hmacSecret}, nil
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generating RSA key: %v", err)
+	}
+
+	privBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	})
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling RSA public key: %v", err)
+	}
+
+	return &signingKey{
+		Method:     "RS256",
+		PrivateKey: privBytes,
+		PublicKey:  pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pubBytes}),
+	}, nil
+}
+
+// putSigningKey sets key as the only signing key, discarding any previous
+// history. It's for GenerateSigningKey, which is meant for initial setup
+// rather than a rotation that needs to keep old tokens verifying.
+func (a *apiServer) putSigningKey(ctx context.Context, key *signingKey) error {
+	return a.writeSigningKeys(ctx, []*signingKey{key})
+}
+
+// rotateSigningKey makes key the active signing key while retaining up to
+// maxSigningKeyHistory-1 of the previously active keys, so verifyToken can
+// keep validating tokens signed before this rotation.
+func (a *apiServer) rotateSigningKey(ctx context.Context, key *signingKey) error {
+	existing, err := a.loadSigningKeys(ctx)
+	if err != nil {
+		existing = nil
+	}
+	return a.writeSigningKeys(ctx, prependSigningKey(key, existing))
+}
+
+// prependSigningKey makes key the newest entry of existing (which is
+// ordered newest first), dropping whichever entries fall past
+// maxSigningKeyHistory.
+func prependSigningKey(key *signingKey, existing []*signingKey) []*signingKey {
+	keys := append([]*signingKey{key}, existing...)
+	if len(keys) > maxSigningKeyHistory {
+		keys = keys[:maxSigningKeyHistory]
+	}
+	return keys
+}
+
+func (a *apiServer) writeSigningKeys(ctx context.Context, keys []*signingKey) error {
+	history := signingKeyHistory{Keys: make([]signingKey, len(keys))}
+	for i, key := range keys {
+		history.Keys[i] = *key
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("error marshalling signing key: %v", err)
+	}
+	if _, err := a.etcdClient.Put(ctx, a.signingKeyPrefix, string(data)); err != nil {
+		return fmt.Errorf("error writing signing key: %v", err)
+	}
+	a.signingKeyMu.Lock()
+	a.cachedSigningKeys = keys
+	a.signingKeyMu.Unlock()
+	return nil
+}
+
+// tokenRecord is the etcd-side revocation entry for an outstanding token.
+// It exists purely for RevokeToken and ListTokens to act on; verifyToken
+// only cares whether a record is present at all.
+type tokenRecord struct {
+	Subject   string
+	Provider  string
+	IssuedAt  int64
+	ExpiresAt int64
+}
+
+// generateToken mints a signed JWT for username, storing a revocation
+// record in etcd keyed by the token's jti. The etcd lease still enforces
+// the TTL; verifyToken only consults etcd to check for early revocation.
+func (a *apiServer) generateToken(ctx context.Context, username string, groups []string, admin bool, provider string, ttlSecs int64) (string, error) {
+	return a.generateClaimsToken(ctx, username, groups, admin, nil, provider, ttlSecs)
+}
+
+// generateScopedToken mints a signed JWT for username that's restricted to
+// scope rather than carrying the subject's full identity.
+func (a *apiServer) generateScopedToken(ctx context.Context, username string, scope *authclient.Scope, ttlSecs int64) (string, error) {
+	return a.generateClaimsToken(ctx, username, nil, false, scope, "", ttlSecs)
+}
+
+func (a *apiServer) generateClaimsToken(ctx context.Context, username string, groups []string, admin bool, scope *authclient.Scope, provider string, ttlSecs int64) (string, error) {
+	keys, err := a.loadSigningKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+	key := keys[0] // the active key; see signingKeyHistory
+
+	jti := uuid.NewWithoutDashes()
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(ttlSecs) * time.Second)
+	claims := pachClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   username,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+			Id:        jti,
+		},
+		Admin:  admin,
+		Groups: groups,
+		Scope:  scope,
+	}
+
+	method, signingKeyMaterial, err := key.jwtSigningInputs()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := jwt.NewWithClaims(method, claims).SignedString(signingKeyMaterial)
+	if err != nil {
+		return "", fmt.Errorf("error signing token: %v", err)
+	}
+
+	record, err := json.Marshal(&tokenRecord{
+		Subject:   username,
+		Provider:  provider,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error marshalling token record: %v", err)
+	}
+
+	lease, err := a.etcdClient.Grant(ctx, ttlSecs)
+	if err != nil {
+		return "", fmt.Errorf("error granting token TTL: %v", err)
+	}
+	if _, err := a.etcdClient.Put(ctx, path.Join(a.tokenPrefix, jti), string(record), etcd.WithLease(lease.ID)); err != nil {
+		return "", fmt.Errorf("error storing the revocation record: %v", err)
+	}
+
+	return token, nil
+}
+
+func (k *signingKey) jwtSigningInputs() (jwt.SigningMethod, interface{}, error) {
+	switch k.Method {
+	case "HS256":
+		return jwt.SigningMethodHS256, k.PrivateKey, nil
+	case "RS256":
+		priv, err := jwtParseRSAPrivateKey(k.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return jwt.SigningMethodRS256, priv, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown signing method %q", k.Method)
+	}
+}
+
+func jwtParseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("error decoding PEM block for RSA private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// claimsFromContext extracts and verifies the auth token carried in ctx,
+// returning its claims.
+func (a *apiServer) claimsFromContext(ctx context.Context) (*pachClaims, error) {
+	token := ctx.Value(authnToken)
+	if token == nil {
+		return nil, fmt.Errorf("auth token not found in context")
+	}
+
+	tokenStr, ok := token.(string)
+	if !ok {
+		return nil, fmt.Errorf("auth token found in context is malformed")
+	}
+
+	return a.verifyToken(ctx, tokenStr)
+}
+
+// verifyToken checks tokenStr's signature and expiry against the active
+// signing key or, failing that, any key RotateSigningKey has retained in
+// history, then confirms the token hasn't been revoked by checking that
+// its jti still has a live record in etcd. It returns the claims on
+// success.
+func (a *apiServer) verifyToken(ctx context.Context, tokenStr string) (*pachClaims, error) {
+	keys, err := a.loadSigningKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims pachClaims
+	var verifyErr error
+	for _, key := range keys {
+		claims = pachClaims{}
+		_, verifyErr = jwt.ParseWithClaims(tokenStr, &claims, keyFuncFor(key))
+		if verifyErr == nil {
+			break
+		}
+	}
+	if verifyErr != nil {
+		return nil, fmt.Errorf("invalid token: %v", verifyErr)
+	}
+
+	resp, err := a.etcdClient.Get(ctx, path.Join(a.tokenPrefix, claims.Id))
+	if err != nil {
+		return nil, fmt.Errorf("error checking token revocation status: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	return &claims, nil
+}
+
+// keyFuncFor returns the jwt.Keyfunc that validates a token against key,
+// for use as one candidate in verifyToken's retry-over-history loop.
+func keyFuncFor(key *signingKey) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		switch key.Method {
+		case "HS256":
+			return key.PrivateKey, nil
+		case "RS256":
+			block, _ := pem.Decode(key.PublicKey)
+			if block == nil {
+				return nil, fmt.Errorf("error decoding PEM block for RSA public key")
+			}
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unknown signing method %q", key.Method)
+		}
+	}
+}
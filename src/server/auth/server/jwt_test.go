@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestKeyFuncForRoundTrip(t *testing.T) {
+	key, err := newSigningKey(nil)
+	if err != nil {
+		t.Fatalf("newSigningKey: %v", err)
+	}
+	method, material, err := key.jwtSigningInputs()
+	if err != nil {
+		t.Fatalf("jwtSigningInputs: %v", err)
+	}
+
+	tokenStr, err := jwt.NewWithClaims(method, pachClaims{StandardClaims: jwt.StandardClaims{Subject: "alice"}}).SignedString(material)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	var claims pachClaims
+	if _, err := jwt.ParseWithClaims(tokenStr, &claims, keyFuncFor(key)); err != nil {
+		t.Fatalf("token should verify against the key that signed it: %v", err)
+	}
+	if claims.Subject != "alice" {
+		t.Errorf("Subject = %q, want %q", claims.Subject, "alice")
+	}
+
+	other, err := newSigningKey(nil)
+	if err != nil {
+		t.Fatalf("newSigningKey: %v", err)
+	}
+	if _, err := jwt.ParseWithClaims(tokenStr, &pachClaims{}, keyFuncFor(other)); err == nil {
+		t.Error("token should not verify against a different key")
+	}
+}
+
+// TestPrependSigningKey exercises the bookkeeping RotateSigningKey relies
+// on to keep old tokens verifying: the bug under review was that only the
+// active key was ever kept, so rotating invalidated every outstanding
+// token. The new key must become active, and up to
+// maxSigningKeyHistory-1 displaced keys must be retained rather than
+// dropped.
+func TestPrependSigningKey(t *testing.T) {
+	k1 := &signingKey{Method: "HS256", PrivateKey: []byte("k1")}
+	k2 := &signingKey{Method: "HS256", PrivateKey: []byte("k2")}
+	k3 := &signingKey{Method: "HS256", PrivateKey: []byte("k3")}
+
+	keys := prependSigningKey(k1, nil)
+	if len(keys) != 1 || keys[0] != k1 {
+		t.Fatalf("first key: got %v, want [k1]", keys)
+	}
+
+	keys = prependSigningKey(k2, keys)
+	if len(keys) != 2 || keys[0] != k2 || keys[1] != k1 {
+		t.Fatalf("after rotating to k2: got %v, want [k2 k1]", keys)
+	}
+
+	// A third rotation must still make the newest key active, and must not
+	// grow the history past maxSigningKeyHistory even though k1 is still
+	// technically displaced.
+	keys = prependSigningKey(k3, keys)
+	if len(keys) != maxSigningKeyHistory {
+		t.Fatalf("history length = %d, want %d", len(keys), maxSigningKeyHistory)
+	}
+	if keys[0] != k3 {
+		t.Fatalf("active key after third rotation = %v, want k3", keys[0])
+	}
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+
+	"github.com/coreos/go-oidc"
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	ldap "gopkg.in/ldap.v2"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+)
+
+const (
+	providersPrefix = "/id-providers"
+
+	githubProviderName = "github"
+	ldapProviderName   = "ldap"
+	oidcProviderName   = "oidc"
+	tlsProviderName    = "tls"
+)
+
+// IDProvider authenticates a set of credentials carried in an
+// AuthenticateRequest and, if they're valid, returns the username they
+// belong to plus the groups the provider itself vouches for (GitHub org
+// logins, LDAP memberOf, OIDC groups claim). Each provider owns its own
+// notion of "credentials" -- for GitHub that's an OAuth token, for LDAP a
+// bind DN and password, etc.
+type IDProvider interface {
+	// AuthenticateCredentials validates req and returns the username it
+	// authenticates as and the groups it belongs to. It returns an error if
+	// the credentials are missing, malformed, or rejected by the backing
+	// identity system.
+	AuthenticateCredentials(ctx context.Context, req *authclient.AuthenticateRequest) (username string, groups []string, err error)
+}
+
+// githubProvider authenticates a GitHub OAuth token by asking the GitHub
+// API who it belongs to. This is the provider pachyderm has always used.
+// Its groups are the logins of the user's GitHub orgs; team membership is
+// not fetched.
+type githubProvider struct{}
+
+func (githubProvider) AuthenticateCredentials(ctx context.Context, req *authclient.AuthenticateRequest) (string, []string, error) {
+	if req.GithubToken == "" {
+		return "", nil, fmt.Errorf("no GitHub token in request")
+	}
+
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{
+			AccessToken: req.GithubToken,
+		},
+	)
+	tc := oauth2.NewClient(ctx, ts)
+	gclient := github.NewClient(tc)
+
+	// Passing the empty string gets us the authenticated user
+	user, _, err := gclient.Users.Get(ctx, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting the authenticated user: %v", err)
+	}
+
+	// Passing the empty string gets us the authenticated user's orgs
+	orgs, _, err := gclient.Organizations.List(ctx, "", nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting the authenticated user's orgs: %v", err)
+	}
+	groups := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		groups = append(groups, org.GetLogin())
+	}
+
+	return user.GetName(), groups, nil
+}
+
+// LDAPConfig holds everything an ldapProvider needs to bind to a directory
+// and resolve a username to a DN. It's serialized into etcd so that it can
+// be updated without restarting pachd.
+type LDAPConfig struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter is an LDAP filter template; "%s" is replaced with the
+	// username supplied in the request, e.g. "(uid=%s)".
+	UserFilter string
+}
+
+// ldapProvider authenticates a username/password pair by binding to an
+// LDAP directory, first as a service account to search for the user's DN
+// and then as the user itself to verify the password.
+type ldapProvider struct {
+	config LDAPConfig
+}
+
+func newLDAPProvider(config LDAPConfig) *ldapProvider {
+	return &ldapProvider{config: config}
+}
+
+func (p *ldapProvider) AuthenticateCredentials(ctx context.Context, req *authclient.AuthenticateRequest) (string, []string, error) {
+	if req.LDAPUsername == "" || req.LDAPPassword == "" {
+		return "", nil, fmt.Errorf("no LDAP credentials in request")
+	}
+
+	conn, err := ldap.Dial("tcp", p.config.URL)
+	if err != nil {
+		return "", nil, fmt.Errorf("error connecting to LDAP server: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+		return "", nil, fmt.Errorf("error binding service account to LDAP server: %v", err)
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		p.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(req.LDAPUsername)),
+		[]string{"dn", "memberOf"},
+		nil,
+	)
+	result, err := conn.Search(searchRequest)
+	if err != nil {
+		return "", nil, fmt.Errorf("error searching LDAP directory for %v: %v", req.LDAPUsername, err)
+	}
+	if len(result.Entries) != 1 {
+		return "", nil, fmt.Errorf("expected exactly one LDAP entry for %v, got %v", req.LDAPUsername, len(result.Entries))
+	}
+
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, req.LDAPPassword); err != nil {
+		return "", nil, fmt.Errorf("invalid LDAP credentials for %v: %v", req.LDAPUsername, err)
+	}
+
+	return req.LDAPUsername, entry.GetAttributeValues("memberOf"), nil
+}
+
+// OIDCConfig holds the issuer and client ID pachd uses to validate ID
+// tokens against an OpenID Connect provider, discovered at startup via the
+// issuer's well-known configuration document.
+type OIDCConfig struct {
+	Issuer   string
+	ClientID string
+}
+
+// oidcProvider authenticates an OIDC ID token by verifying its signature
+// against the issuer's discovered keys and extracting the username from
+// the token's claims.
+type oidcProvider struct {
+	config   OIDCConfig
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCProvider(ctx context.Context, config OIDCConfig) (*oidcProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering OIDC issuer %v: %v", config.Issuer, err)
+	}
+	return &oidcProvider{
+		config:   config,
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+func (p *oidcProvider) AuthenticateCredentials(ctx context.Context, req *authclient.AuthenticateRequest) (string, []string, error) {
+	if req.OIDCToken == "" {
+		return "", nil, fmt.Errorf("no OIDC token in request")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, req.OIDCToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("error verifying OIDC token: %v", err)
+	}
+
+	var claims struct {
+		Subject string   `json:"sub"`
+		Email   string   `json:"email"`
+		Groups  []string `json:"groups"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, fmt.Errorf("error reading OIDC claims: %v", err)
+	}
+
+	username := claims.Email
+	if username == "" {
+		username = claims.Subject
+	}
+	if username == "" {
+		return "", nil, fmt.Errorf("OIDC token has neither a sub nor an email claim")
+	}
+	return username, claims.Groups, nil
+}
+
+// tlsProvider authenticates a client by trusting the CommonName in the
+// verified certificate chain presented during the mutual-TLS handshake.
+// It's meant for service-to-service auth where the caller's cert is
+// provisioned out of band.
+type tlsProvider struct{}
+
+func (tlsProvider) AuthenticateCredentials(ctx context.Context, req *authclient.AuthenticateRequest) (string, []string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", nil, fmt.Errorf("no peer information in context")
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", nil, fmt.Errorf("connection was not authenticated with TLS")
+	}
+
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", nil, fmt.Errorf("no verified client certificate chain")
+	}
+
+	subject := chains[0][0].Subject
+	if subject.CommonName == "" {
+		return "", nil, fmt.Errorf("client certificate has no CommonName")
+	}
+	// mutual-TLS certs don't carry group membership; org-level access must
+	// come through an explicit role binding instead.
+	return commonNameToUsername(subject), nil, nil
+}
+
+// commonNameToUsername exists so that the mapping from a certificate
+// Subject to a pachyderm username is in one place, in case we later want
+// to incorporate the OU or other fields.
+func commonNameToUsername(subject pkix.Name) string {
+	return subject.CommonName
+}
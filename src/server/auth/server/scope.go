@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+)
+
+// GetScopedToken mints a child token that carries the (repo, max-scope)
+// grants listed in req.Repos instead of the full identity of the caller presenting req.ParentToken. The resulting
+// token authenticates as the parent's username, but Authorize additionally
+// intersects the ACL grant against the embedded scope, so it can only act
+// within the repos (and up to the per-repo max scope) the parent chose to
+// delegate. It's meant for handing pipeline workers a token that expires
+// with the job instead of impersonating the user who created the pipeline.
+func (a *apiServer) GetScopedToken(ctx context.Context, req *authclient.GetScopedTokenRequest) (resp *authclient.GetScopedTokenResponse, retErr error) {
+	func() { a.Log(req, nil, nil, 0) }()
+	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
+
+	claims, err := a.verifyToken(ctx, req.ParentToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parent token: %v", err)
+	}
+
+	if claims.Scope != nil {
+		return nil, fmt.Errorf("cannot derive a scoped token from an already-scoped token")
+	}
+
+	identity, err := a.identityResolver.ResolveIdentity(ctx, claims.Subject, claims.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-check admin status live rather than trusting claims.Admin: that
+	// bit was baked in at Authenticate time, so an admin demoted since
+	// would otherwise keep bypassing the delegation cap below for as long
+	// as their token remains unexpired. Every other admin check in this
+	// package (requireAdmin, Authorize, GetACL, WhoAmI) re-resolves for the
+	// same reason.
+	admin, err := a.isAdmin(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := &authclient.Scope{Repos: req.Repos}
+	for _, repoScope := range req.Repos {
+		var acl authclient.ACL
+		if err := a.acls.ReadOnly(ctx).Get(repoScope.Repo, &acl); err != nil {
+			return nil, fmt.Errorf("ACL not found for repo %v", repoScope.Repo)
+		}
+		granted := scopeFromACL(acl, identity)
+		if repoScope.Scope > granted && !admin {
+			return nil, fmt.Errorf("cannot delegate scope %v on repo %v: caller only has %v", repoScope.Scope, repoScope.Repo, granted)
+		}
+	}
+
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = defaultTokenTTLSecs
+	}
+
+	token, err := a.generateScopedToken(ctx, claims.Subject, scope, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("error generating scoped token: %v", err)
+	}
+
+	return &authclient.GetScopedTokenResponse{
+		Token: token,
+	}, nil
+}
+
+// authorizedScope returns the max Scope identity has on repo via acl,
+// taking into account both its principals (username, groups, roles) and,
+// if tokenScope is set (the caller presented a scoped token rather than
+// one carrying full identity), the narrower grant embedded in it. Callers
+// get tokenScope off the claims returned by authorizedIdentity rather than
+// this function re-verifying the token itself.
+func (a *apiServer) authorizedScope(identity *Identity, repo string, acl authclient.ACL, tokenScope *authclient.Scope) authclient.Scope_Scope {
+	granted := scopeFromACL(acl, identity)
+	if tokenScope == nil {
+		return granted
+	}
+
+	for _, repoScope := range tokenScope.Repos {
+		if repoScope.Repo == repo {
+			if repoScope.Scope < granted {
+				return repoScope.Scope
+			}
+			return granted
+		}
+	}
+	return authclient.Scope_NONE
+}
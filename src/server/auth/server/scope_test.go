@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"testing"
+
+	authclient "github.com/pachyderm/pachyderm/src/client/auth"
+)
+
+func TestAuthorizedScope(t *testing.T) {
+	identity := &Identity{Username: "alice"}
+	acl := authclient.ACL{Entries: map[string]authclient.Scope_Scope{
+		userPrincipal("alice"): authclient.Scope_WRITER,
+	}}
+
+	tests := []struct {
+		name       string
+		tokenScope *authclient.Scope
+		want       authclient.Scope_Scope
+	}{
+		{
+			name:       "unscoped token gets the full ACL grant",
+			tokenScope: nil,
+			want:       authclient.Scope_WRITER,
+		},
+		{
+			name: "scoped token narrower than the ACL grant wins",
+			tokenScope: &authclient.Scope{Repos: []*authclient.Scope_RepoScope{
+				{Repo: "repo", Scope: authclient.Scope_READER},
+			}},
+			want: authclient.Scope_READER,
+		},
+		{
+			name: "scoped token can't exceed the ACL grant",
+			tokenScope: &authclient.Scope{Repos: []*authclient.Scope_RepoScope{
+				{Repo: "repo", Scope: authclient.Scope_OWNER},
+			}},
+			want: authclient.Scope_WRITER,
+		},
+		{
+			name: "scoped token naming a different repo grants nothing here",
+			tokenScope: &authclient.Scope{Repos: []*authclient.Scope_RepoScope{
+				{Repo: "other-repo", Scope: authclient.Scope_OWNER},
+			}},
+			want: authclient.Scope_NONE,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &apiServer{}
+			got := a.authorizedScope(identity, "repo", acl, test.tokenScope)
+			if got != test.want {
+				t.Errorf("authorizedScope() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}